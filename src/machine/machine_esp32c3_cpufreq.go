@@ -0,0 +1,70 @@
+// +build esp32c3
+
+package machine
+
+import (
+	"device/esp"
+	"runtime"
+)
+
+// CPUFrequency selects one of the CPU clock configurations documented in the
+// "CPU Clock Frequency" table of the ESP32-C3 technical reference manual.
+type CPUFrequency uint8
+
+const (
+	// FreqXTAL runs the CPU directly off the 40MHz crystal, bypassing the
+	// PLL entirely. This is not the chip's out-of-reset clock -- that's an
+	// internal ~20MHz RC oscillator, switched away from in runtime's main()
+	// before SetCPUFrequency is ever called -- but it is the lowest
+	// frequency SetCPUFrequency can select, and the one SetLightSleep parks
+	// the CPU at for the duration of a sleep.
+	FreqXTAL CPUFrequency = iota
+	// Freq40MHz is an alias for FreqXTAL: on the C3 the crystal is 40MHz, so
+	// there's no separate low-power PLL step below it.
+	Freq40MHz
+	// Freq80MHz runs the CPU off the PLL at 80MHz.
+	Freq80MHz
+	// Freq160MHz runs the CPU off the PLL at 160MHz, the maximum supported
+	// speed for this chip.
+	Freq160MHz
+)
+
+// SetCPUFrequency reprograms SYSTEM_SYSCLK_CONF and SYSTEM_CPU_PER_CONF_REG
+// to switch the CPU to freq, waiting for the PLL to lock before returning
+// when switching to one of the PLL-derived frequencies.
+//
+// Unlike the older TIMG0-based runtime clock, the SYSTIMER peripheral that
+// backs time.Now and time.Sleep runs off a fixed 16MHz clock independent of
+// the CPU frequency, so switching CPU frequency doesn't require rescaling
+// any tick-per-nanosecond factor; runtime.NotifyCPUFrequencyChanged is still
+// called for the benefit of any peripheral driver that does derive its
+// timing from the CPU or APB clock (e.g. UART baud rate generators).
+func SetCPUFrequency(freq CPUFrequency) {
+	switch freq {
+	case FreqXTAL, Freq40MHz:
+		// SOC_CLK_SEL=0 selects the XTAL directly, bypassing the PLL.
+		esp.SYSTEM.SYSCLK_CONF.ClearBits(1 << esp.SYSTEM_SYSCLK_CONF_SOC_CLK_SEL_Pos)
+		esp.SYSTEM.CPU_PER_CONF_REG.Set(0)
+
+	case Freq80MHz:
+		esp.SYSTEM.SYSCLK_CONF.Set(1 << esp.SYSTEM_SYSCLK_CONF_SOC_CLK_SEL_Pos)
+		esp.SYSTEM.CPU_PER_CONF_REG.Set(esp.SYSTEM_CPU_PER_CONF_REG_CPU_WAIT_MODE_FORCE_ON | esp.SYSTEM_CPU_PER_CONF_REG_PLL_FREQ_SEL)
+		waitForPLLLock()
+
+	case Freq160MHz:
+		esp.SYSTEM.SYSCLK_CONF.Set(1 << esp.SYSTEM_SYSCLK_CONF_SOC_CLK_SEL_Pos)
+		esp.SYSTEM.CPU_PER_CONF_REG.Set(esp.SYSTEM_CPU_PER_CONF_REG_CPU_WAIT_MODE_FORCE_ON | esp.SYSTEM_CPU_PER_CONF_REG_PLL_FREQ_SEL | 1<<esp.SYSTEM_CPU_PER_CONF_REG_CPUPERIOD_SEL_Pos)
+		waitForPLLLock()
+	}
+
+	runtime.NotifyCPUFrequencyChanged()
+}
+
+// waitForPLLLock blocks until the 480MHz PLL used to derive 80/160MHz has
+// locked, so callers don't run off an unstable clock immediately after the
+// switch.
+func waitForPLLLock() {
+	for esp.RTC_CNTL.RTC_ANA_CONF.Get()&esp.RTC_CNTL_RTC_ANA_CONF_PLL_I2C_PU == 0 {
+	}
+}
+
@@ -0,0 +1,9 @@
+// +build esp32c3,!esp32c3_boot80mhz
+
+package machine
+
+// DefaultBootCPUFrequency is the frequency main() switches to at boot. It
+// defaults to the maximum 160MHz; build with the esp32c3_boot80mhz tag to
+// boot straight into 80MHz instead, mirroring ESP-IDF's
+// CONFIG_ESP_DEFAULT_CPU_FREQ_MHZ for battery-powered apps.
+const DefaultBootCPUFrequency = Freq160MHz
@@ -0,0 +1,8 @@
+// +build esp32c3,esp32c3_boot80mhz
+
+package machine
+
+// DefaultBootCPUFrequency is the frequency main() switches to at boot. See
+// machine_esp32c3_cpufreq_160mhz.go for the default; this file is only
+// built when the esp32c3_boot80mhz tag is passed to `tinygo build`.
+const DefaultBootCPUFrequency = Freq80MHz
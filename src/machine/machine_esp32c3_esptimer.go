@@ -0,0 +1,254 @@
+// +build esp32c3
+
+package machine
+
+import (
+	"device/esp"
+	"runtime/interrupt"
+	"runtime/volatile"
+	"time"
+)
+
+// esptimer exposes the SYSTIMER comparators TARGET0 and TARGET1 as
+// one-shot or periodic callbacks, fired from the SYSTIMER target-triggered
+// interrupts. This lets user code (and the scheduler) wait on a real timer
+// IRQ instead of busy-looping on ticks().
+//
+// Comparators are a scarce resource: there are only two of them, shared
+// between After, AfterFunc and NewTicker, each of which panics if none are
+// free.
+
+// Only comparators 0 and 1 are available here: TARGET2 is reserved by the
+// runtime for sleepTicks, which needs a comparator of its own to wake the
+// core from WFI independently of any user timers.
+const numSystimerComparators = 2
+
+var systimerComparators [numSystimerComparators]struct {
+	inUse      bool
+	generation uint32 // bumped every time the slot is freed; see Timer.Stop
+	periodic   bool
+	period     uint64 // in SYSTIMER ticks, only used when periodic
+	callback   func()
+}
+
+// Timer represents a single SYSTIMER comparator programmed for a one-shot or
+// periodic callback. generation pins it to the specific occupancy of
+// comparator it was handed at allocation time, so a late Stop can't disarm a
+// different Timer/Ticker that has since been allocated the same comparator.
+type Timer struct {
+	comparator int
+	generation uint32
+}
+
+// Ticker repeatedly sends the current time on C from a SYSTIMER comparator
+// interrupt until Stop is called.
+type Ticker struct {
+	C <-chan time.Time
+	t Timer
+}
+
+// AfterFunc waits for the duration to elapse and then calls f in the
+// SYSTIMER interrupt handler. It returns a Timer that can be used to cancel
+// the call using Stop.
+func AfterFunc(d time.Duration, f func()) *Timer {
+	comparator, generation := allocSystimerComparator()
+	t := &Timer{comparator: comparator, generation: generation}
+	armSystimerComparator(t.comparator, uint64(d.Nanoseconds())*16/1000, false, f)
+	return t
+}
+
+// After waits for the duration to elapse and then sends the current time on
+// the returned channel, backed by a SYSTIMER comparator interrupt rather
+// than a busy loop.
+func After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	AfterFunc(d, func() {
+		ch <- time.Now()
+	})
+	return ch
+}
+
+// NewTicker returns a new Ticker that sends the current time on its C
+// channel every d, driven by a dedicated SYSTIMER comparator interrupt. A
+// tick is dropped if the previous one has not been received yet.
+func NewTicker(d time.Duration) *Ticker {
+	comparator, generation := allocSystimerComparator()
+	period := uint64(d.Nanoseconds()) * 16 / 1000
+	ch := make(chan time.Time, 1)
+	t := &Ticker{C: ch, t: Timer{comparator: comparator, generation: generation}}
+	armSystimerComparator(comparator, period, true, func() {
+		select {
+		case ch <- time.Now():
+		default:
+		}
+	})
+	return t
+}
+
+// Stop cancels the timer. It has no effect if the timer already fired: once
+// fired, a one-shot timer's comparator is freed and may have been handed to
+// a different Timer or Ticker by the time Stop runs, and freeSystimerComparator
+// checks the generation to make sure Stop only ever disarms the comparator
+// it was actually given.
+func (t *Timer) Stop() {
+	freeSystimerComparator(t.comparator, t.generation)
+}
+
+// Stop cancels the ticker. See Timer.Stop.
+func (t *Ticker) Stop() {
+	freeSystimerComparator(t.t.comparator, t.t.generation)
+}
+
+func allocSystimerComparator() (n int, generation uint32) {
+	for i := range systimerComparators {
+		if !systimerComparators[i].inUse {
+			systimerComparators[i].inUse = true
+			return i, systimerComparators[i].generation
+		}
+	}
+	panic("machine: no free SYSTIMER comparator")
+}
+
+// freeSystimerComparator disarms comparator n, but only if it's still owned
+// by the generation that's asking: a Stop call racing a comparator that
+// already fired and was reallocated to a new Timer/Ticker must not disarm
+// that new owner.
+func freeSystimerComparator(n int, generation uint32) {
+	if !systimerComparators[n].inUse || systimerComparators[n].generation != generation {
+		return
+	}
+	esp.SYSTIMER.CONF.ClearBits(systimerTargetWorkEnBit(n))
+	systimerComparators[n].inUse = false
+	systimerComparators[n].generation++
+	systimerComparators[n].callback = nil
+}
+
+// armSystimerComparator programs comparator n to match `target` ticks from
+// now (or every `target` ticks, if periodic) and enables its interrupt.
+func armSystimerComparator(n int, target uint64, periodic bool, callback func()) {
+	systimerComparators[n].periodic = periodic
+	systimerComparators[n].period = target
+	systimerComparators[n].callback = callback
+
+	now := uint64(systimerNow())
+	deadline := now + target
+
+	targetHi(n).Set(uint32(deadline >> 32))
+	targetLo(n).Set(uint32(deadline))
+	if periodic {
+		targetConfPeriod(n, target)
+	} else {
+		// Reset the whole TARGETn_CONF register: a previous occupant of this
+		// comparator (freed by freeSystimerComparator, which only clears its
+		// WORK_EN bit in SYSTIMER_CONF) may have left PERIOD_MODE and a stale
+		// period set, which would otherwise make a freshly-armed one-shot
+		// timer keep firing like the old periodic one.
+		targetConf(n).Set(0)
+	}
+	esp.SYSTIMER.CONF.SetBits(systimerTargetWorkEnBit(n))
+	esp.SYSTIMER.INT_ENA.SetBits(1 << uint(n))
+
+	interrupt.New(irqSystimerTarget(n), systimerTargetInterrupt).Enable()
+}
+
+// systimerTargetInterrupt is the shared handler for both user-facing
+// SYSTIMER comparator interrupts; it re-arms periodic timers and clears the pending
+// bit before invoking the user callback.
+func systimerTargetInterrupt(intr interrupt.Interrupt) {
+	for n := 0; n < numSystimerComparators; n++ {
+		if esp.SYSTIMER.INT_RAW.Get()&(1<<uint(n)) == 0 {
+			continue
+		}
+		esp.SYSTIMER.INT_CLR.Set(1 << uint(n))
+
+		cb := systimerComparators[n].callback
+		if systimerComparators[n].periodic {
+			// Advance the target by one period to keep firing instead of
+			// re-reading "now", which would drift under interrupt latency.
+			hi := targetHi(n).Get()
+			lo := targetLo(n).Get()
+			deadline := (uint64(hi)<<32 | uint64(lo)) + systimerComparators[n].period
+			targetHi(n).Set(uint32(deadline >> 32))
+			targetLo(n).Set(uint32(deadline))
+		} else {
+			freeSystimerComparator(n, systimerComparators[n].generation)
+		}
+
+		if cb != nil {
+			cb()
+		}
+	}
+}
+
+// systimerNow reads the current SYSTIMER UNIT0 value, the same counter used
+// by the runtime for timekeeping.
+func systimerNow() int64 {
+	esp.SYSTIMER.UNIT0_OP.Set(esp.SYSTIMER_UNIT0_OP_TIMER_UNIT0_UPDATE)
+	for esp.SYSTIMER.UNIT0_OP.Get()&esp.SYSTIMER_UNIT0_OP_TIMER_UNIT0_VALUE_VALID == 0 {
+	}
+	return int64(uint64(esp.SYSTIMER.UNIT0_VALUE_LO.Get()) | uint64(esp.SYSTIMER.UNIT0_VALUE_HI.Get())<<32)
+}
+
+// The three TARGETn registers are laid out identically in the SYSTIMER
+// peripheral, so the following helpers pick out the right register for a
+// given comparator index instead of duplicating the arming logic per
+// comparator.
+
+func targetConf(n int) *volatile.Register32 {
+	switch n {
+	case 0:
+		return &esp.SYSTIMER.TARGET0_CONF
+	case 1:
+		return &esp.SYSTIMER.TARGET1_CONF
+	default:
+		return &esp.SYSTIMER.TARGET2_CONF
+	}
+}
+
+func targetHi(n int) *volatile.Register32 {
+	switch n {
+	case 0:
+		return &esp.SYSTIMER.TARGET0_HI
+	case 1:
+		return &esp.SYSTIMER.TARGET1_HI
+	default:
+		return &esp.SYSTIMER.TARGET2_HI
+	}
+}
+
+func targetLo(n int) *volatile.Register32 {
+	switch n {
+	case 0:
+		return &esp.SYSTIMER.TARGET0_LO
+	case 1:
+		return &esp.SYSTIMER.TARGET1_LO
+	default:
+		return &esp.SYSTIMER.TARGET2_LO
+	}
+}
+
+// targetConfPeriod programs the comparator's period field for periodic
+// (autoreload) mode, so the hardware keeps firing every `period` ticks
+// without the ISR having to reprogram TARGETn_HI/LO on every single match.
+func targetConfPeriod(n int, period uint64) {
+	targetConf(n).Set(esp.SYSTIMER_TARGET0_CONF_TARGET0_PERIOD_MODE | uint32(period)<<esp.SYSTIMER_TARGET0_CONF_TARGET0_PERIOD_Pos)
+}
+
+// systimerTargetWorkEnBit returns the SYSTIMER_CONF TARGETn_WORK_EN bit for
+// comparator n.
+func systimerTargetWorkEnBit(n int) uint32 {
+	switch n {
+	case 0:
+		return esp.SYSTIMER_CONF_TARGET0_WORK_EN
+	case 1:
+		return esp.SYSTIMER_CONF_TARGET1_WORK_EN
+	default:
+		return esp.SYSTIMER_CONF_TARGET2_WORK_EN
+	}
+}
+
+// irqSystimerTarget returns the PLIC interrupt source for comparator n's
+// target-triggered interrupt.
+func irqSystimerTarget(n int) int {
+	return int(esp.IRQ_SYSTIMER_TARGET0 + n)
+}
@@ -6,6 +6,7 @@ import (
 	"device/esp"
 	"device/riscv"
 	"machine"
+	"runtime/interrupt"
 	"unsafe"
 )
 
@@ -22,9 +23,11 @@ func postinit() {}
 //export main
 func main() {
 	// This initialization configures the following things:
-	// * It disables all watchdog timers. They might be useful at some point in
-	//   the future, but will need integration into the scheduler. For now,
-	//   they're all disabled.
+	// * It disables the Timer 0 and RTC watchdogs at boot. Programs that want
+	//   watchdog supervision now get it through runtime/watchdog.Configure,
+	//   which re-arms both timers with a real timeout and reset/print
+	//   behavior; leaving them disabled here is the correct default for
+	//   programs that don't import that package at all.
 	// * It sets the CPU frequency to 160MHz, which is the maximum speed allowed
 	//   for this CPU. Lower frequencies might be possible in the future, but
 	//   running fast and sleeping quickly is often also a good strategy to save
@@ -33,10 +36,12 @@ func main() {
 	// to protect against stack overflows. See
 	// esp_cpu_configure_region_protection in ESP-IDF.
 
-	// Disable Timer 0 watchdog.
+	// Disable Timer 0 watchdog. runtime/watchdog.Configure re-arms it with a
+	// real timeout if the program opts in.
 	esp.TIMG0.WDTCONFIG0_REG.Set(0)
 
-	// Disable RTC watchdog.
+	// Disable RTC watchdog. runtime/watchdog.Configure re-arms it as the
+	// super-watchdog if the program opts in.
 	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1)
 	esp.RTC_CNTL.RTC_WDTCONFIG0.Set(0)
 
@@ -44,16 +49,16 @@ func main() {
 	esp.RTC_CNTL.RTC_SWD_WPROTECT.Set(0x8F1D312A)
 	esp.RTC_CNTL.RTC_SWD_CONF.Set(esp.RTC_CNTL_RTC_SWD_CONF_SWD_DISABLE)
 
-	// Change CPU frequency from 20MHz to 80MHz, by switching from the XTAL to
-	// the PLL clock source (see table "CPU Clock Frequency" in the reference
-	// manual).
-	esp.SYSTEM.SYSCLK_CONF.Set(1 << esp.SYSTEM_SYSCLK_CONF_SOC_CLK_SEL_Pos)
+	// Enable the clock and de-assert reset for the SYSTIMER peripheral, which
+	// is used below for timekeeping instead of TIMG0.
+	esp.SYSTEM.PERIP_CLK_EN0.SetBits(esp.SYSTEM_PERIP_CLK_EN0_SYSTIMER_CLK_EN)
+	esp.SYSTEM.PERIP_RST_EN0.ClearBits(esp.SYSTEM_PERIP_RST_EN0_SYSTIMER_RST)
 
-	// Change CPU frequency from 80MHz to 160MHz by setting SYSTEM_CPUPERIOD_SEL
-	// to 1 (see table "CPU Clock Frequency" in the reference manual).
-	// Note: we might not want to set SYSTEM_CPU_WAIT_MODE_FORCE_ON to save
-	// power. It is set here to keep the default on reset.
-	esp.SYSTEM.CPU_PER_CONF_REG.Set(esp.SYSTEM_CPU_PER_CONF_REG_CPU_WAIT_MODE_FORCE_ON | esp.SYSTEM_CPU_PER_CONF_REG_PLL_FREQ_SEL | 1<<esp.SYSTEM_CPU_PER_CONF_REG_CPUPERIOD_SEL_Pos)
+	// Switch the CPU off its 20MHz reset clock and up to the configured boot
+	// frequency (160MHz by default, or 80MHz when built with the
+	// esp32c3_boot80mhz tag; see table "CPU Clock Frequency" in the
+	// reference manual).
+	machine.SetCPUFrequency(machine.DefaultBootCPUFrequency)
 
 	// Initialize .bss: zero-initialized global variables.
 	// The .data section has already been loaded by the ROM bootloader.
@@ -63,17 +68,30 @@ func main() {
 		ptr = unsafe.Pointer(uintptr(ptr) + 4)
 	}
 
-	// Configure timer 0 in timer group 0, for timekeeping.
-	//   EN:       Enable the timer.
-	//   INCREASE: Count up every tick (as opposed to counting down).
-	//   DIVIDER:  16-bit prescaler, set to 2 for dividing the APB clock by two
-	//             (40MHz).
-	esp.TIMG0.T0CONFIG_REG.Set(esp.TIMG_T0CONFIG_REG_T0_EN | esp.TIMG_T0CONFIG_REG_T0_INCREASE | 2<<esp.TIMG_T0CONFIG_REG_T0_DIVIDER_Pos)
+	// Configure SYSTIMER UNIT0 for timekeeping. Unlike the TIMG timers, the
+	// SYSTIMER runs off a fixed 16MHz clock derived from the XTAL regardless
+	// of the CPU frequency, which makes it a much better fit for a
+	// monotonic clock: it doesn't need to be reprogrammed whenever
+	// SetCPUFrequency changes the core speed.
+	//   TIMER_UNIT0_WORK_EN: keep the unit counting, it's never stopped.
+	//   CLK_FO:              force the SYSTIMER clock on, it's otherwise
+	//                        gated when the APB bus is idle.
+	esp.SYSTIMER.CONF.Set(esp.SYSTIMER_CONF_TIMER_UNIT0_WORK_EN | esp.SYSTIMER_CONF_CLK_FO)
 
-	// Set the timer counter value to 0.
-	esp.TIMG0.T0LOADLO_REG.Set(0)
-	esp.TIMG0.T0LOADHI_REG.Set(0)
-	esp.TIMG0.T0LOAD_REG.Set(0) // value doesn't matter.
+	// Reset UNIT0 to 0 so ticks() starts counting from boot.
+	esp.SYSTIMER.UNIT0_LOAD_HI.Set(0)
+	esp.SYSTIMER.UNIT0_LOAD_LO.Set(0)
+	esp.SYSTIMER.UNIT0_LOAD.Set(esp.SYSTIMER_UNIT0_LOAD_TIMER_UNIT0_LOAD)
+
+	// sleepTicks below wakes the core from WFI via SYSTIMER TARGET2; enable
+	// its interrupt once up front so sleepTicks only has to arm the target.
+	esp.SYSTIMER.INT_ENA.SetBits(1 << 2)
+	interrupt.New(esp.IRQ_SYSTIMER_TARGET2, sleepTicksInterrupt).Enable()
+
+	// Route CPU exceptions (illegal instruction, load/store misaligned, load
+	// access fault, etc.) into handleFault below, so a hard fault produces a
+	// register dump over UART instead of a silent lockup.
+	installExceptionHandler()
 
 	// Initialize the heap, call main.main, etc.
 	run()
@@ -83,35 +101,176 @@ func main() {
 }
 
 func ticks() timeUnit {
-	// First, update the LO and HI register pair by writing any value to the
-	// register. This allows reading the pair atomically.
-	esp.TIMG0.T0UPDATE_REG.Set(0)
-	// Then read the two 32-bit parts of the timer.
-	return timeUnit(uint64(esp.TIMG0.T0LO_REG.Get()) | uint64(esp.TIMG0.T0HI_REG.Get())<<32)
+	// Latch the current counter value into the UNIT0_VALUE_HI/LO register
+	// pair so the two 32-bit halves can be read without racing a rollover.
+	esp.SYSTIMER.UNIT0_OP.Set(esp.SYSTIMER_UNIT0_OP_TIMER_UNIT0_UPDATE)
+	for esp.SYSTIMER.UNIT0_OP.Get()&esp.SYSTIMER_UNIT0_OP_TIMER_UNIT0_VALUE_VALID == 0 {
+	}
+	// Then read the two 32-bit parts of the (52-bit) counter.
+	return timeUnit(uint64(esp.SYSTIMER.UNIT0_VALUE_LO.Get()) | uint64(esp.SYSTIMER.UNIT0_VALUE_HI.Get())<<32)
 }
 
 func nanosecondsToTicks(ns int64) timeUnit {
-	// Calculate the number of ticks from the number of nanoseconds. At a 80MHz
-	// APB clock, that's 25 nanoseconds per tick with a timer prescaler of 2:
-	// 25 = 1e9 / (80MHz / 2)
-	return timeUnit(ns / 25)
+	// SYSTIMER UNIT0 runs off a fixed 16MHz clock, so each tick is 62.5ns.
+	// Multiply first to keep the division exact: ns * 16 / 1000.
+	return timeUnit(ns * 16 / 1000)
 }
 
 func ticksToNanoseconds(ticks timeUnit) int64 {
 	// See nanosecondsToTicks.
-	return int64(ticks) * 25
+	return int64(ticks) * 1000 / 16
 }
 
+// idleHook, when set, is called every time sleepTicks is about to suspend
+// the CPU. runtime/watchdog uses this via SetIdleHook to auto-feed handles
+// that opted into auto-feed-on-idle, without the runtime needing to know
+// anything about the watchdog itself.
+var idleHook func()
+
+// SetIdleHook registers f to be called whenever the scheduler is about to go
+// idle (i.e. just before sleepTicks suspends the CPU in WFI). Only one hook
+// can be registered; a second call replaces the first.
+func SetIdleHook(f func()) {
+	idleHook = f
+}
+
+// NotifyCPUFrequencyChanged is called by machine.SetCPUFrequency after
+// reprogramming the CPU clock. Timekeeping itself doesn't need adjusting:
+// SYSTIMER runs off a fixed 16MHz clock independent of the CPU frequency, so
+// nanosecondsToTicks/ticksToNanoseconds stay valid across the switch. This
+// hook exists for peripheral drivers (e.g. UART baud rate generators) that
+// do derive their timing from the CPU or APB clock.
+func NotifyCPUFrequencyChanged() {}
+
+// lightSleepEnabled is toggled by machine.SetLightSleep. When set, sleepTicks
+// additionally drops the CPU to the 40MHz XTAL around the WFI, restoring
+// machine.DefaultBootCPUFrequency (160MHz unless built with the
+// esp32c3_boot80mhz tag) on wake, trading a bit of wakeup latency for lower
+// idle current.
+var lightSleepEnabled bool
+
+// setLightSleepEnabled is exported to the machine package via go:linkname,
+// backing machine.SetLightSleep.
+func setLightSleepEnabled(enabled bool) {
+	lightSleepEnabled = enabled
+}
+
+// sleepTicks suspends the CPU in WFI until d ticks have elapsed, waking up
+// on the SYSTIMER TARGET2 interrupt instead of busy-polling ticks().
 func sleepTicks(d timeUnit) {
-	sleepUntil := ticks() + d
-	for ticks() < sleepUntil {
-		// TODO: suspend the CPU to not burn power here unnecessarily.
+	if idleHook != nil {
+		idleHook()
 	}
-}
 
-func abort() {
-	// lock up forever
-	for {
+	sleepUntil := uint64(ticks() + d)
+
+	esp.SYSTIMER.TARGET2_HI.Set(uint32(sleepUntil >> 32))
+	esp.SYSTIMER.TARGET2_LO.Set(uint32(sleepUntil))
+	esp.SYSTIMER.CONF.SetBits(esp.SYSTIMER_CONF_TARGET2_WORK_EN)
+
+	if lightSleepEnabled {
+		// Drop to the XTAL, bypassing the PLL entirely, for the duration of
+		// the sleep. Unlike Freq80MHz/Freq160MHz this doesn't need
+		// waitForPLLLock, so it costs nothing on the way into WFI; SYSTIMER
+		// keeps ticking off its own fixed 16MHz clock regardless of which
+		// frequency the CPU is parked at.
+		machine.SetCPUFrequency(machine.FreqXTAL)
+	}
+
+	for timeUnit(ticks()) < timeUnit(sleepUntil) {
 		riscv.Asm("wfi")
 	}
+
+	if lightSleepEnabled {
+		// Restore the boot-time PLL frequency on wake.
+		machine.SetCPUFrequency(machine.DefaultBootCPUFrequency)
+	}
+}
+
+// sleepTicksInterrupt acknowledges the TARGET2 compare match that wakes
+// sleepTicks from WFI. It also disarms TARGET2_WORK_EN, matching
+// freeSystimerComparator's handling of the user-facing comparators in
+// machine_esp32c3_esptimer.go: left armed, the already-passed compare value
+// would keep re-asserting the match until sleepTicks rearms it for the next
+// wait, burning cycles between sleeps. sleepTicks itself re-checks the
+// deadline after every wakeup, so there's nothing else to do here.
+func sleepTicksInterrupt(intr interrupt.Interrupt) {
+	esp.SYSTIMER.CONF.ClearBits(esp.SYSTIMER_CONF_TARGET2_WORK_EN)
+	esp.SYSTIMER.INT_CLR.Set(1 << 2)
+}
+
+// riscvExceptionNames decodes the mcause exception codes this chip can
+// raise into the names used in the RISC-V privileged spec, for the
+// diagnostic dump printed by handleFault.
+var riscvExceptionNames = [...]string{
+	0:  "instruction address misaligned",
+	1:  "instruction access fault",
+	2:  "illegal instruction",
+	3:  "breakpoint",
+	4:  "load address misaligned",
+	5:  "load access fault",
+	6:  "store/AMO address misaligned",
+	7:  "store/AMO access fault",
+	8:  "environment call",
+	11: "environment call from M-mode",
+}
+
+// previousTrapVector is the mtvec value in effect immediately before
+// installExceptionHandler runs: the trap vector the startup code points at
+// runtime/interrupt's own dispatcher, which every interrupt.New(...).
+// Enable() call elsewhere in this port depends on. __trap_vector (defined in
+// runtime_esp32c3_trap.s) forwards every peripheral interrupt there
+// unchanged, and only intercepts synchronous exceptions itself.
+var previousTrapVector uintptr
+
+// lastInterruptMepc/RA/SP capture the PC, return address and stack pointer
+// of whatever was running at the moment the most recent peripheral
+// interrupt trapped, snapshotted by __trap_vector before it forwards to
+// previousTrapVector and any registered runtime/interrupt handler runs.
+// Reading them from inside a Go ISR (as opposed to, say, capturing ra/sp
+// with inline asm from within the ISR body) is the only way to see where
+// the interrupted code actually was, rather than the ISR's own call-linkage
+// and stack frame; runtime/watchdog uses this via go:linkname to report
+// where a stalled task was when its watchdog fired.
+var (
+	lastInterruptMepc uintptr
+	lastInterruptRA   uintptr
+	lastInterruptSP   uintptr
+)
+
+// installExceptionHandler points mtvec at __trap_vector (defined in
+// runtime_esp32c3_trap.s), after stashing the previous mtvec value in
+// previousTrapVector so PLIC-routed peripheral interrupts keep reaching
+// runtime/interrupt's dispatcher exactly as before. __trap_vector tells the
+// two kinds of trap apart by mcause's sign bit: synchronous exceptions
+// (illegal instruction, misaligned or faulting loads/stores, etc.) are
+// routed into handleFault below instead of silently resetting into the boot
+// ROM; everything else is forwarded to previousTrapVector unchanged.
+func installExceptionHandler() {
+	riscv.AsmFull("csrr {mtvec}, mtvec", map[string]interface{}{"mtvec": &previousTrapVector})
+	riscv.Asm("la t0, __trap_vector\ncsrw mtvec, t0")
+}
+
+// handleFault is called from __trap_vector on an unrecovered exception, with
+// the trapped mcause/mepc/mtval and the ra/sp captured at fault time. It
+// prints a decoded RISC-V exception summary and a minimal backtrace over
+// UART, then calls panicHandler, which either halts or resets depending on
+// the esp32c3_panic_silent_reboot build tag.
+//export handleFault
+func handleFault(mcause, mepc, mtval, ra, sp uintptr) {
+	print("panic: unhandled exception\n")
+	if int(mcause) >= 0 && int(mcause) < len(riscvExceptionNames) && riscvExceptionNames[mcause] != "" {
+		print("  cause: ", riscvExceptionNames[mcause], " (mcause=", mcause, ")\n")
+	} else {
+		print("  cause: mcause=", mcause, "\n")
+	}
+	print("  mepc=0x", mepc, " mtval=0x", mtval, "\n")
+	print("  ra=0x", ra, " sp=0x", sp, "\n")
+
+	panicHandler()
+}
+
+func abort() {
+	print("panic: main() returned unexpectedly\n")
+	panicHandler()
 }
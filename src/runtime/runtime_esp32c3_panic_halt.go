@@ -0,0 +1,18 @@
+// +build esp32c3,!esp32c3_panic_silent_reboot
+
+package runtime
+
+import "device/riscv"
+
+// panicHandler halts the core in WFI after a fault has been reported,
+// mirroring ESP-IDF's PANIC_PRINT_HALT behavior. This is the default: it
+// keeps the diagnostic output on the console instead of immediately
+// resetting it away, which is what you want while debugging on the bench.
+// Build with the esp32c3_panic_silent_reboot tag for field-deployed devices
+// that should instead reboot and try to recover; see
+// runtime_esp32c3_panic_reboot.go.
+func panicHandler() {
+	for {
+		riscv.Asm("wfi")
+	}
+}
@@ -0,0 +1,18 @@
+// +build esp32c3,esp32c3_panic_silent_reboot
+
+package runtime
+
+import "device/esp"
+
+// panicHandler triggers a software system reset after a fault has been
+// reported, mirroring ESP-IDF's PANIC_SILENT_REBOOT behavior: rather than
+// bricking an unattended, field-deployed board until someone power-cycles
+// it, the diagnostics are printed and the chip tries again.
+func panicHandler() {
+	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1)
+	esp.RTC_CNTL.RTC_OPTIONS0.SetBits(esp.RTC_CNTL_RTC_OPTIONS0_SW_SYS_RST)
+	for {
+		// The reset takes effect within a few cycles; park here in case it's
+		// somehow delayed so we never fall through to returning garbage.
+	}
+}
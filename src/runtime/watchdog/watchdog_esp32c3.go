@@ -0,0 +1,242 @@
+// +build esp32c3
+
+// Package watchdog provides a supervised task watchdog on top of the TIMG0
+// and RTC watchdog timers, modeled after ESP-IDF's task watchdog (esp_task_wdt):
+// goroutines register a named Handle, Feed it periodically (or opt into
+// auto-feed on scheduler idle), and the watchdog resets the board with a
+// diagnostic dump if any registered handle goes quiet for longer than the
+// configured timeout.
+package watchdog
+
+import (
+	"device/esp"
+	"device/riscv"
+	"runtime"
+	"runtime/interrupt"
+	"time"
+	_ "unsafe" // for go:linkname
+)
+
+// lastInterruptMepc/RA/SP mirror runtime.lastInterruptMepc/RA/SP: the
+// PC/return-address/stack-pointer of whatever was interrupted, snapshotted
+// by __trap_vector before the Go call into timg0WatchdogExpired below could
+// clobber them. Reading these instead of capturing ra/sp from inside this
+// ISR's own body is what actually reports where the stalled task was.
+//
+//go:linkname lastInterruptMepc runtime.lastInterruptMepc
+var lastInterruptMepc uintptr
+
+//go:linkname lastInterruptRA runtime.lastInterruptRA
+var lastInterruptRA uintptr
+
+//go:linkname lastInterruptSP runtime.lastInterruptSP
+var lastInterruptSP uintptr
+
+func init() {
+	runtime.SetIdleHook(onIdle)
+}
+
+// PanicAction selects what happens when a handle misses its deadline.
+type PanicAction uint8
+
+const (
+	// PanicReset prints diagnostics and then resets the chip. This is the
+	// only safe choice for unattended, field-deployed devices.
+	PanicReset PanicAction = iota
+	// PanicPrint only prints diagnostics and halts, useful while debugging
+	// on the bench.
+	PanicPrint
+)
+
+// Handle identifies a task registered with Add.
+type Handle uint8
+
+const maxHandles = 8
+
+type handleState struct {
+	inUse    bool
+	name     string
+	autoFeed bool
+	fedAt    timeUnit
+}
+
+var (
+	handles      [maxHandles]handleState
+	timeout      timeUnit
+	action       PanicAction
+	configured   bool
+)
+
+// timeUnit is a time in nanoseconds, as returned by now(); watchdog only
+// needs it for relative comparisons against timeout, and ms() converts it to
+// milliseconds for the hardware timer registers in Configure.
+type timeUnit int64
+
+const (
+	// timgAPBFrequencyHz is the fixed APB clock TIMG0's watchdog counts
+	// against. It's independent of the CPU core frequency switches
+	// machine.SetCPUFrequency makes (those only reclock the CPU, not the
+	// APB bus), so it's safe to hardcode here rather than read back from
+	// machine.
+	timgAPBFrequencyHz = 80_000_000
+
+	// timgWDTPrescale divides timgAPBFrequencyHz down to exactly 1kHz, i.e.
+	// one WDTCONFIGn tick per millisecond, so WDTCONFIG2_REG/WDTCONFIG3_REG
+	// can be programmed straight from timeout.ms() below. WDTCONFIG1_REG
+	// holds this prescaler; WDTCONFIG0_REG only holds enable/stage-action
+	// bits and WDTCONFIG2_REG onward hold the per-stage tick counts -- the
+	// stage timeouts themselves never have a defined unit without it.
+	timgWDTPrescale = timgAPBFrequencyHz / 1000
+
+	// rtcWDTTicksPerMillisecond converts milliseconds to RTC_WDTCONFIG1
+	// ticks. The RTC WDT counts against RTC_SLOW_CLK, which this runtime
+	// never switches off its default internal ~150kHz RC oscillator, so
+	// 1ms is approximately 150 ticks.
+	rtcWDTTicksPerMillisecond = 150
+)
+
+// Configure arms the watchdog: the per-task timer (TIMG0 WDT) fires after
+// timeout if any registered handle hasn't been fed, and the RTC WDT is armed
+// as a last-resort super-watchdog at 2x timeout in case the TIMG0 ISR itself
+// gets stuck. panicAction selects what the expiry handler does once it has
+// printed its diagnostics.
+func Configure(to time.Duration, panicAction PanicAction) {
+	timeout = timeUnit(to.Nanoseconds())
+	action = panicAction
+	configured = true
+
+	// TIMG0 WDT, stage 0: interrupt (not reset) after `timeout`, so the ISR
+	// gets a chance to print diagnostics before anything resets the chip.
+	esp.TIMG0.WDTWPROTECT_REG.Set(0x50D83AA1)
+	esp.TIMG0.WDTCONFIG0_REG.Set(esp.TIMG_WDTCONFIG0_REG_WDT_EN |
+		esp.TIMG_WDTCONFIG0_REG_WDT_STG0_INT |
+		esp.TIMG_WDTCONFIG0_REG_WDT_STG1_RESET_SYSTEM)
+	esp.TIMG0.WDTCONFIG1_REG.Set(timgWDTPrescale)
+	esp.TIMG0.WDTCONFIG2_REG.Set(uint32(timeout.ms()))
+	esp.TIMG0.WDTCONFIG3_REG.Set(uint32(timeout.ms()) * 2) // stage 1 fallback
+	esp.TIMG0.WDTFEED_REG.Set(1)
+	esp.TIMG0.WDTWPROTECT_REG.Set(0)
+
+	interrupt.New(esp.IRQ_TG0_WDT_LEVEL, timg0WatchdogExpired).Enable()
+
+	// RTC WDT as the super-watchdog: resets unconditionally at 2x timeout,
+	// with no software ISR to get stuck in.
+	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1)
+	esp.RTC_CNTL.RTC_WDTCONFIG0.Set(esp.RTC_CNTL_RTC_WDTCONFIG0_WDT_EN |
+		esp.RTC_CNTL_RTC_WDTCONFIG0_WDT_STG0_RESET_SYSTEM)
+	esp.RTC_CNTL.RTC_WDTCONFIG1.Set(uint32(timeout.ms()) * 2 * rtcWDTTicksPerMillisecond)
+	esp.RTC_CNTL.RTC_WDTFEED.Set(1)
+	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1 ^ 0xFFFFFFFF)
+}
+
+// Add registers a new watchdog task and returns a Handle to Feed or Remove
+// it. autoFeedOnIdle opts this handle into being fed automatically whenever
+// the scheduler goes idle, for tasks that don't have a natural "I'm alive"
+// checkpoint of their own.
+func Add(name string, autoFeedOnIdle bool) Handle {
+	for i := range handles {
+		if !handles[i].inUse {
+			handles[i] = handleState{inUse: true, name: name, autoFeed: autoFeedOnIdle, fedAt: now()}
+			return Handle(i)
+		}
+	}
+	panic("watchdog: too many registered handles")
+}
+
+// Feed resets the deadline for h, acknowledging that the owning goroutine is
+// still making progress.
+func Feed(h Handle) {
+	handles[h].fedAt = now()
+}
+
+// Remove unregisters h. It no longer counts towards the watchdog deadline.
+func Remove(h Handle) {
+	handles[h] = handleState{}
+}
+
+// onIdle is registered with runtime.SetIdleHook in init, and is called from
+// the scheduler's idle hook (runtime.sleepTicks) just before the core
+// suspends. It feeds every handle that opted into auto-feed-on-idle, then
+// feeds the underlying hardware timers only if that leaves every registered
+// handle within its deadline. Without that check, any unrelated idle
+// activity elsewhere in the program (a ticker, another goroutine's
+// time.Sleep) would feed the hardware WDT forever regardless of whether a
+// manually-fed handle has actually gone stale, making
+// timg0WatchdogExpired's stalest-handle scan unreachable.
+func onIdle() {
+	if !configured {
+		return
+	}
+	t := now()
+	for i := range handles {
+		if handles[i].inUse && handles[i].autoFeed {
+			handles[i].fedAt = t
+		}
+	}
+	for i := range handles {
+		if handles[i].inUse && t-handles[i].fedAt > timeout {
+			return
+		}
+	}
+	esp.TIMG0.WDTWPROTECT_REG.Set(0x50D83AA1)
+	esp.TIMG0.WDTFEED_REG.Set(1)
+	esp.TIMG0.WDTWPROTECT_REG.Set(0)
+	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1)
+	esp.RTC_CNTL.RTC_WDTFEED.Set(1)
+	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1 ^ 0xFFFFFFFF)
+}
+
+// timg0WatchdogExpired runs when TIMG0 WDT stage 0 fires, meaning at least
+// one registered handle has gone silent for longer than timeout. It reports
+// the stalest handle plus a minimal RISC-V backtrace, then either halts or
+// resets depending on the configured PanicAction.
+func timg0WatchdogExpired(intr interrupt.Interrupt) {
+	esp.TIMG0.WDTWPROTECT_REG.Set(0x50D83AA1)
+	esp.TIMG0.WDTINT_CLR_REG.Set(1)
+	esp.TIMG0.WDTWPROTECT_REG.Set(0)
+
+	offender := "<none>"
+	t := now()
+	oldest := timeUnit(-1)
+	for i := range handles {
+		if !handles[i].inUse || handles[i].autoFeed {
+			continue
+		}
+		age := t - handles[i].fedAt
+		if age > timeout && age > oldest {
+			oldest = age
+			offender = handles[i].name
+		}
+	}
+
+	print("watchdog: task \"", offender, "\" did not feed within timeout\n")
+	print("  mepc=", lastInterruptMepc, " ra=", lastInterruptRA, " sp=", lastInterruptSP, "\n")
+
+	if action == PanicPrint {
+		// Disarm both hardware watchdogs first, so TIMG0 stage 1 and the RTC
+		// super-watchdog don't reset the chip out from under the halt.
+		esp.TIMG0.WDTWPROTECT_REG.Set(0x50D83AA1)
+		esp.TIMG0.WDTCONFIG0_REG.Set(0)
+		esp.TIMG0.WDTWPROTECT_REG.Set(0)
+		esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1)
+		esp.RTC_CNTL.RTC_WDTCONFIG0.Set(0)
+		esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1 ^ 0xFFFFFFFF)
+		for {
+			riscv.Asm("wfi")
+		}
+	}
+
+	// PanicReset: trigger a full system reset via the RTC.
+	esp.RTC_CNTL.RTC_WDTWPROTECT.Set(0x50D83AA1)
+	esp.RTC_CNTL.RTC_OPTIONS0.SetBits(esp.RTC_CNTL_RTC_OPTIONS0_SW_SYS_RST)
+}
+
+func (t timeUnit) ms() int64 {
+	return int64(t) / 1e6
+}
+
+// now returns the current monotonic time in nanoseconds, used only to
+// compare handle ages against timeout.
+func now() timeUnit {
+	return timeUnit(time.Now().UnixNano())
+}